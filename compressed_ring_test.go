@@ -0,0 +1,82 @@
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompressedSampleRingHistogram checks that compressedSampleRing
+// buffers and evicts native histogram samples correctly, exercising
+// the tagHistogram/aux-slice path that the float-only tests in
+// querier_test.go don't reach.
+func TestCompressedSampleRingHistogram(t *testing.T) {
+	r := newCompressedSampleRing(2, 4)
+
+	hist := func(n int64) *Histogram { return &Histogram{Count: uint64(n), Sum: float64(n)} }
+
+	input := []sample{
+		{t: 1, v: 10},
+		{t: 2, h: hist(2)},
+		{t: 3, v: 30},
+		{t: 4, h: hist(4)},
+		{t: 5, v: 50},
+	}
+
+	for _, s := range input {
+		r.add(s)
+	}
+
+	got := r.samples()
+	// Only samples within delta=2 of the last added timestamp (5)
+	// survive: t=3 (v=30), t=4 (h=hist(4)), t=5 (v=50).
+	require.Len(t, got, 3)
+
+	require.Equal(t, int64(3), got[0].t)
+	require.Equal(t, 30.0, got[0].v)
+	require.Nil(t, got[0].h)
+
+	require.Equal(t, int64(4), got[1].t)
+	require.Equal(t, hist(4), got[1].h)
+
+	require.Equal(t, int64(5), got[2].t)
+	require.Equal(t, 50.0, got[2].v)
+	require.Nil(t, got[2].h)
+}
+
+// TestCompressedSampleRingFloatHistogram mirrors
+// TestCompressedSampleRingHistogram but exercises the
+// tagFloatHistogram/aux-slice path for float histogram samples.
+func TestCompressedSampleRingFloatHistogram(t *testing.T) {
+	r := newCompressedSampleRing(2, 4)
+
+	hist := func(n int64) *FloatHistogram { return &FloatHistogram{Count: float64(n), Sum: float64(n)} }
+
+	input := []sample{
+		{t: 1, v: 10},
+		{t: 2, fh: hist(2)},
+		{t: 3, v: 30},
+		{t: 4, fh: hist(4)},
+		{t: 5, v: 50},
+	}
+
+	for _, s := range input {
+		r.add(s)
+	}
+
+	got := r.samples()
+	// Only samples within delta=2 of the last added timestamp (5)
+	// survive: t=3 (v=30), t=4 (fh=hist(4)), t=5 (v=50).
+	require.Len(t, got, 3)
+
+	require.Equal(t, int64(3), got[0].t)
+	require.Equal(t, 30.0, got[0].v)
+	require.Nil(t, got[0].fh)
+
+	require.Equal(t, int64(4), got[1].t)
+	require.Equal(t, hist(4), got[1].fh)
+
+	require.Equal(t, int64(5), got[2].t)
+	require.Equal(t, 50.0, got[2].v)
+	require.Nil(t, got[2].fh)
+}
@@ -0,0 +1,94 @@
+package tsdb
+
+// Span describes a contiguous run of non-empty buckets within a
+// Histogram or FloatHistogram, relative to the previous span (or to
+// bucket zero for the first span in a slice).
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+// Histogram is a native histogram sample with integer bucket counts, as
+// produced directly by instrumented client libraries.
+type Histogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     uint64
+	Count         uint64
+	Sum           float64
+
+	PositiveSpans   []Span
+	PositiveBuckets []int64
+	NegativeSpans   []Span
+	NegativeBuckets []int64
+}
+
+// Copy returns a deep copy of h.
+func (h *Histogram) Copy() *Histogram {
+	if h == nil {
+		return nil
+	}
+	c := *h
+	c.PositiveSpans = append([]Span(nil), h.PositiveSpans...)
+	c.PositiveBuckets = append([]int64(nil), h.PositiveBuckets...)
+	c.NegativeSpans = append([]Span(nil), h.NegativeSpans...)
+	c.NegativeBuckets = append([]int64(nil), h.NegativeBuckets...)
+	return &c
+}
+
+// ToFloat returns a FloatHistogram with the same bucket layout and
+// counts as h.
+func (h *Histogram) ToFloat() *FloatHistogram {
+	fh := &FloatHistogram{
+		Schema:        h.Schema,
+		ZeroThreshold: h.ZeroThreshold,
+		ZeroCount:     float64(h.ZeroCount),
+		Count:         float64(h.Count),
+		Sum:           h.Sum,
+		PositiveSpans: append([]Span(nil), h.PositiveSpans...),
+		NegativeSpans: append([]Span(nil), h.NegativeSpans...),
+	}
+	fh.PositiveBuckets = make([]float64, len(h.PositiveBuckets))
+	var acc int64
+	for i, b := range h.PositiveBuckets {
+		acc += b
+		fh.PositiveBuckets[i] = float64(acc)
+	}
+	fh.NegativeBuckets = make([]float64, len(h.NegativeBuckets))
+	acc = 0
+	for i, b := range h.NegativeBuckets {
+		acc += b
+		fh.NegativeBuckets[i] = float64(acc)
+	}
+	return fh
+}
+
+// FloatHistogram mirrors Histogram but stores bucket counts as floats.
+// It is the representation used once a histogram has passed through
+// arithmetic (e.g. rate() or averaging across series), where bucket
+// deltas are no longer guaranteed to be integers.
+type FloatHistogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     float64
+	Count         float64
+	Sum           float64
+
+	PositiveSpans   []Span
+	PositiveBuckets []float64
+	NegativeSpans   []Span
+	NegativeBuckets []float64
+}
+
+// Copy returns a deep copy of h.
+func (h *FloatHistogram) Copy() *FloatHistogram {
+	if h == nil {
+		return nil
+	}
+	c := *h
+	c.PositiveSpans = append([]Span(nil), h.PositiveSpans...)
+	c.PositiveBuckets = append([]float64(nil), h.PositiveBuckets...)
+	c.NegativeSpans = append([]Span(nil), h.NegativeSpans...)
+	c.NegativeBuckets = append([]float64(nil), h.NegativeBuckets...)
+	return &c
+}
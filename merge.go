@@ -0,0 +1,309 @@
+package tsdb
+
+import (
+	"container/heap"
+
+	"github.com/fabxc/tsdb/labels"
+)
+
+// NewMergeSeriesSet performs a k-way merge of sets, each already sorted
+// by label set, into a single SeriesSet sorted by label set. Series
+// that share a label set across more than one input are merged into a
+// single series via mergedSeries, which merges their samples in time
+// order and drops duplicate timestamps, rather than concatenating them
+// the way newPartitionSeriesSet combines two inputs.
+//
+// It replaces folding newPartitionSeriesSet pairwise over a binary tree
+// of the inputs with a single call, and ties on a shared label set or
+// timestamp are always broken in favor of the earliest input in sets,
+// matching the convention mergeChunks uses. It is not currently a
+// performance win: nestedPartitionSeriesSet (see merge_test.go) already
+// walks a single O(log k) path of its balanced tree per Next(), and
+// BenchmarkMergeSeriesSet measures the container/heap-based merge here
+// as ~2x slower at k=2..128. Prefer this over nesting
+// newPartitionSeriesSet by hand for the simpler call site and the
+// single, well-defined tie-break rule, not for throughput.
+func NewMergeSeriesSet(sets []SeriesSet) SeriesSet {
+	switch len(sets) {
+	case 0:
+		return newListSeriesSet(nil)
+	case 1:
+		return sets[0]
+	}
+	return newMergeSeriesSet(sets)
+}
+
+type mergeSeriesSet struct {
+	h   seriesSetHeap
+	cur Series
+	err error
+}
+
+func newMergeSeriesSet(sets []SeriesSet) *mergeSeriesSet {
+	s := &mergeSeriesSet{}
+	for i, set := range sets {
+		s.push(set, i)
+	}
+	heap.Init(&s.h)
+	return s
+}
+
+// push advances set to its first series and adds it to the heap if it
+// has one. idx is set's position in the original sets argument, used to
+// break ties on a shared label set in its favor.
+func (s *mergeSeriesSet) push(set SeriesSet, idx int) {
+	if set.Next() {
+		s.h = append(s.h, seriesSetHeapItem{set: set, idx: idx})
+	} else if err := set.Err(); err != nil {
+		s.err = err
+	}
+}
+
+// advance pops the current heap root, which must be item, to its next
+// series, re-inserting it into the heap if it still has data.
+func (s *mergeSeriesSet) advance(item seriesSetHeapItem) {
+	heap.Pop(&s.h)
+	if item.set.Next() {
+		heap.Push(&s.h, item)
+	} else if err := item.set.Err(); err != nil {
+		s.err = err
+	}
+}
+
+func (s *mergeSeriesSet) At() Series {
+	return s.cur
+}
+
+func (s *mergeSeriesSet) Err() error {
+	return s.err
+}
+
+func (s *mergeSeriesSet) Next() bool {
+	if s.err != nil || len(s.h) == 0 {
+		return false
+	}
+
+	top := s.h[0]
+	series := []Series{top.set.At()}
+	s.advance(top)
+
+	// Pull in every other input currently pointing at the same label
+	// set so the caller sees one series per label set, not one per
+	// input. seriesSetHeap breaks ties by idx, so these come off the
+	// heap in original input order and series ends up ordered the same
+	// way.
+	for len(s.h) > 0 && labels.Compare(s.h[0].set.At().Labels(), series[0].Labels()) == 0 {
+		next := s.h[0]
+		series = append(series, next.set.At())
+		s.advance(next)
+	}
+
+	if len(series) == 1 {
+		s.cur = series[0]
+	} else {
+		s.cur = &mergedSeries{series: series}
+	}
+	return true
+}
+
+// seriesSetHeapItem pairs a SeriesSet with its position in the slice
+// NewMergeSeriesSet was called with, so ties can be broken by original
+// input order.
+type seriesSetHeapItem struct {
+	set SeriesSet
+	idx int
+}
+
+// seriesSetHeap is a container/heap.Interface over a set of SeriesSets,
+// ordered by the label set each is currently positioned at, then by
+// original input order.
+type seriesSetHeap []seriesSetHeapItem
+
+func (h seriesSetHeap) Len() int { return len(h) }
+
+func (h seriesSetHeap) Less(i, j int) bool {
+	if d := labels.Compare(h[i].set.At().Labels(), h[j].set.At().Labels()); d != 0 {
+		return d < 0
+	}
+	return h[i].idx < h[j].idx
+}
+
+func (h seriesSetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *seriesSetHeap) Push(x interface{}) {
+	*h = append(*h, x.(seriesSetHeapItem))
+}
+
+func (h *seriesSetHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// mergedSeries represents several series that share a label set. Unlike
+// chainedSeries, it does not assume the inputs' time ranges are already
+// disjoint and ordered: it merges their samples in time order, as the
+// underlying SeriesSets may interleave arbitrarily once more than two
+// of them are combined by the heap in mergeSeriesSet.
+type mergedSeries struct {
+	series []Series
+}
+
+func (s *mergedSeries) Labels() labels.Labels {
+	return s.series[0].Labels()
+}
+
+func (s *mergedSeries) Iterator() SeriesIterator {
+	its := make([]SeriesIterator, len(s.series))
+	for i, series := range s.series {
+		its[i] = series.Iterator()
+	}
+	// its is in the same order as s.series, which mergeSeriesSet builds
+	// in original input order, so that order also decides ties in
+	// newMergeSeriesIterator.
+	return newMergeSeriesIterator(its)
+}
+
+// curSample reads the current value out of it, regardless of its kind.
+func curSample(it SeriesIterator) sample {
+	switch it.ValueType() {
+	case ValHistogram:
+		t, h := it.AtHistogram()
+		return sample{t: t, h: h}
+	case ValFloatHistogram:
+		t, fh := it.AtFloatHistogram()
+		return sample{t: t, fh: fh}
+	default:
+		t, v := it.At()
+		return sample{t: t, v: v}
+	}
+}
+
+// mergeSeriesIterator k-way merges a set of iterators in time order, via
+// a min-heap keyed by timestamp and, on a tie, by the iterator's
+// position in the its argument newMergeSeriesIterator was called with.
+// On a timestamp held by more than one input, the earliest one in its
+// wins and the rest are dropped, the same tie-breaking rule mergeChunks
+// uses.
+type mergeSeriesIterator struct {
+	h       seriesIteratorHeap
+	cur     sample
+	started bool
+	err     error
+}
+
+func newMergeSeriesIterator(its []SeriesIterator) *mergeSeriesIterator {
+	it := &mergeSeriesIterator{}
+	for i, sub := range its {
+		it.push(sub, i)
+	}
+	heap.Init(&it.h)
+	return it
+}
+
+// push advances sub to its first sample and adds it to the heap if it
+// has one. idx is sub's position in the its argument
+// newMergeSeriesIterator was called with, used to break timestamp ties
+// in its favor.
+func (it *mergeSeriesIterator) push(sub SeriesIterator, idx int) {
+	if typ := sub.Next(); typ != ValNone {
+		it.h = append(it.h, seriesIteratorHeapItem{it: sub, idx: idx})
+	} else if err := sub.Err(); err != nil {
+		it.err = err
+	}
+}
+
+func (it *mergeSeriesIterator) advance(item seriesIteratorHeapItem) {
+	heap.Pop(&it.h)
+	if typ := item.it.Next(); typ != ValNone {
+		heap.Push(&it.h, item)
+	} else if err := item.it.Err(); err != nil {
+		it.err = err
+	}
+}
+
+func (it *mergeSeriesIterator) Next() ValueType {
+	if it.err != nil || len(it.h) == 0 {
+		return ValNone
+	}
+
+	top := it.h[0]
+	it.cur = curSample(top.it)
+	it.advance(top)
+
+	// Any other input now sitting on the same timestamp is a duplicate;
+	// drop it rather than surfacing it as a second sample. seriesIteratorHeap
+	// breaks timestamp ties by idx, so top above was already the
+	// earliest-indexed input at this timestamp.
+	for len(it.h) > 0 && curSample(it.h[0].it).t == it.cur.t {
+		it.advance(it.h[0])
+	}
+
+	it.started = true
+	return it.cur.valueType()
+}
+
+func (it *mergeSeriesIterator) Seek(t int64) ValueType {
+	for !it.started || it.cur.t < t {
+		if it.Next() == ValNone {
+			return ValNone
+		}
+	}
+	return it.cur.valueType()
+}
+
+func (it *mergeSeriesIterator) At() (int64, float64) { return it.cur.t, it.cur.v }
+
+func (it *mergeSeriesIterator) AtHistogram() (int64, *Histogram) { return it.cur.t, it.cur.h }
+
+func (it *mergeSeriesIterator) AtFloatHistogram() (int64, *FloatHistogram) {
+	return it.cur.t, it.cur.fh
+}
+
+func (it *mergeSeriesIterator) ValueType() ValueType {
+	if !it.started {
+		return ValNone
+	}
+	return it.cur.valueType()
+}
+
+func (it *mergeSeriesIterator) Err() error { return it.err }
+
+// seriesIteratorHeapItem pairs a SeriesIterator with its position in
+// the its argument newMergeSeriesIterator was called with, so ties can
+// be broken by original input order.
+type seriesIteratorHeapItem struct {
+	it  SeriesIterator
+	idx int
+}
+
+// seriesIteratorHeap is a container/heap.Interface over a set of
+// SeriesIterators, ordered by their current timestamp, then by
+// original input order.
+type seriesIteratorHeap []seriesIteratorHeapItem
+
+func (h seriesIteratorHeap) Len() int { return len(h) }
+
+func (h seriesIteratorHeap) Less(i, j int) bool {
+	ti, tj := curSample(h[i].it).t, curSample(h[j].it).t
+	if ti != tj {
+		return ti < tj
+	}
+	return h[i].idx < h[j].idx
+}
+
+func (h seriesIteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *seriesIteratorHeap) Push(x interface{}) {
+	*h = append(*h, x.(seriesIteratorHeapItem))
+}
+
+func (h *seriesIteratorHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,186 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fabxc/tsdb/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func mergeTestSeries(l map[string]string, smpls ...sample) Series {
+	return &mockSeries{
+		labels:   func() labels.Labels { return labels.FromMap(l) },
+		iterator: func() SeriesIterator { return newListSeriesIterator(smpls) },
+	}
+}
+
+func TestMergeSeriesSet(t *testing.T) {
+	t.Run("all empty inputs", func(t *testing.T) {
+		res := NewMergeSeriesSet([]SeriesSet{
+			newListSeriesSet(nil),
+			newListSeriesSet(nil),
+			newListSeriesSet(nil),
+		})
+		require.False(t, res.Next())
+		require.NoError(t, res.Err())
+	})
+
+	t.Run("one empty input among non-empty ones", func(t *testing.T) {
+		res := NewMergeSeriesSet([]SeriesSet{
+			newListSeriesSet(nil),
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 1, v: 1}),
+			}),
+			newListSeriesSet(nil),
+		})
+
+		require.True(t, res.Next())
+		require.Equal(t, labels.FromMap(map[string]string{"a": "a"}), res.At().Labels())
+		smpl, err := expandSeriesIterator(res.At().Iterator())
+		require.NoError(t, err)
+		require.Equal(t, []sample{{t: 1, v: 1}}, smpl)
+
+		require.False(t, res.Next())
+	})
+
+	t.Run("three-way overlap on the same label set", func(t *testing.T) {
+		res := NewMergeSeriesSet([]SeriesSet{
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 1, v: 1}),
+			}),
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 2, v: 2}),
+			}),
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 3, v: 3}),
+			}),
+		})
+
+		require.True(t, res.Next())
+		require.Equal(t, labels.FromMap(map[string]string{"a": "a"}), res.At().Labels())
+
+		smpl, err := expandSeriesIterator(res.At().Iterator())
+		require.NoError(t, err)
+		require.Equal(t, []sample{{t: 1, v: 1}, {t: 2, v: 2}, {t: 3, v: 3}}, smpl)
+
+		require.False(t, res.Next())
+	})
+
+	t.Run("tie on a shared timestamp favors the earliest input", func(t *testing.T) {
+		res := NewMergeSeriesSet([]SeriesSet{
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 1, v: 100}),
+			}),
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 0, v: 1}, sample{t: 1, v: 200}),
+			}),
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 1, v: 300}),
+			}),
+		})
+
+		require.True(t, res.Next())
+		smpl, err := expandSeriesIterator(res.At().Iterator())
+		require.NoError(t, err)
+		// The first input holding t=1 is the first SeriesSet argument,
+		// so its sample (v=100) wins over the second and third inputs'
+		// samples at the same timestamp.
+		require.Equal(t, []sample{{t: 0, v: 1}, {t: 1, v: 100}}, smpl)
+
+		require.False(t, res.Next())
+	})
+
+	t.Run("float histogram samples merge like float samples", func(t *testing.T) {
+		hist := func(n int64) *FloatHistogram { return &FloatHistogram{Count: float64(n), Sum: float64(n)} }
+
+		res := NewMergeSeriesSet([]SeriesSet{
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 1, fh: hist(1)}),
+			}),
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "a"}, sample{t: 2, fh: hist(2)}),
+			}),
+		})
+
+		require.True(t, res.Next())
+		it := res.At().Iterator()
+
+		require.Equal(t, ValFloatHistogram, it.Next())
+		ts, fh := it.AtFloatHistogram()
+		require.Equal(t, int64(1), ts)
+		require.Equal(t, hist(1), fh)
+
+		require.Equal(t, ValFloatHistogram, it.Next())
+		ts, fh = it.AtFloatHistogram()
+		require.Equal(t, int64(2), ts)
+		require.Equal(t, hist(2), fh)
+
+		require.Equal(t, ValNone, it.Next())
+		require.False(t, res.Next())
+	})
+
+	t.Run("interleaved label ordering across inputs", func(t *testing.T) {
+		res := NewMergeSeriesSet([]SeriesSet{
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "2"}, sample{t: 1, v: 1}),
+				mergeTestSeries(map[string]string{"a": "4"}, sample{t: 1, v: 1}),
+			}),
+			newListSeriesSet([]Series{
+				mergeTestSeries(map[string]string{"a": "1"}, sample{t: 1, v: 1}),
+				mergeTestSeries(map[string]string{"a": "3"}, sample{t: 1, v: 1}),
+			}),
+		})
+
+		var got []string
+		for res.Next() {
+			got = append(got, res.At().Labels().Map()["a"])
+		}
+		require.NoError(t, res.Err())
+		require.Equal(t, []string{"1", "2", "3", "4"}, got)
+	})
+}
+
+// nestedPartitionSeriesSet merges sets by folding newPartitionSeriesSet
+// pairwise over a binary tree, the way callers had to before
+// NewMergeSeriesSet existed. It is kept here only to benchmark against.
+func nestedPartitionSeriesSet(sets []SeriesSet) SeriesSet {
+	if len(sets) == 1 {
+		return sets[0]
+	}
+	mid := len(sets) / 2
+	return newPartitionSeriesSet(nestedPartitionSeriesSet(sets[:mid]), nestedPartitionSeriesSet(sets[mid:]))
+}
+
+func benchmarkSets(k int) []SeriesSet {
+	sets := make([]SeriesSet, k)
+	for i := 0; i < k; i++ {
+		sets[i] = newListSeriesSet([]Series{
+			mergeTestSeries(map[string]string{"instance": fmt.Sprintf("%04d", i)}, sample{t: int64(i), v: float64(i)}),
+		})
+	}
+	return sets
+}
+
+func drain(t testing.TB, ss SeriesSet) {
+	t.Helper()
+	for ss.Next() {
+		_ = ss.At()
+	}
+	require.NoError(t, ss.Err())
+}
+
+func BenchmarkMergeSeriesSet(b *testing.B) {
+	for _, k := range []int{2, 8, 32, 128} {
+		b.Run(fmt.Sprintf("k=%d/heap", k), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				drain(b, NewMergeSeriesSet(benchmarkSets(k)))
+			}
+		})
+		b.Run(fmt.Sprintf("k=%d/nestedPartition", k), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				drain(b, nestedPartitionSeriesSet(benchmarkSets(k)))
+			}
+		})
+	}
+}
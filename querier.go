@@ -0,0 +1,359 @@
+package tsdb
+
+import (
+	"sort"
+
+	"github.com/fabxc/tsdb/labels"
+)
+
+// ValueType denotes the type of the value pointed at by a SeriesIterator.
+type ValueType uint8
+
+const (
+	// ValNone means no value at the current position.
+	ValNone ValueType = iota
+	// ValFloat means the current value is a plain float64 sample.
+	ValFloat
+	// ValHistogram means the current value is a native histogram sample.
+	ValHistogram
+	// ValFloatHistogram means the current value is a float histogram
+	// sample, as produced e.g. by applying a PromQL function to a
+	// series of native histograms.
+	ValFloatHistogram
+)
+
+func (v ValueType) String() string {
+	switch v {
+	case ValNone:
+		return "none"
+	case ValFloat:
+		return "float"
+	case ValHistogram:
+		return "histogram"
+	case ValFloatHistogram:
+		return "floathistogram"
+	default:
+		return "unknown"
+	}
+}
+
+// sample is a single sample of a time series. Exactly one of v, h, and
+// fh is meaningful, as indicated by valueType.
+type sample struct {
+	t  int64
+	v  float64
+	h  *Histogram
+	fh *FloatHistogram
+}
+
+// valueType reports the kind of value s holds.
+func (s sample) valueType() ValueType {
+	switch {
+	case s.h != nil:
+		return ValHistogram
+	case s.fh != nil:
+		return ValFloatHistogram
+	default:
+		return ValFloat
+	}
+}
+
+// SeriesIterator iterates over the samples of a time series. A single
+// iterator may yield a mix of float, histogram, and float-histogram
+// samples; callers must check ValueType (or the return value of Seek
+// and Next) before deciding which At* accessor to call.
+type SeriesIterator interface {
+	// Seek advances the iterator forward to the given timestamp.
+	// If there's no value exactly at t, it advances to the first value
+	// after t. It returns ValNone if no value could be found.
+	Seek(t int64) ValueType
+	// At returns the current timestamp/value pair if ValueType is
+	// ValFloat.
+	At() (t int64, v float64)
+	// AtHistogram returns the current timestamp/histogram pair if
+	// ValueType is ValHistogram.
+	AtHistogram() (t int64, h *Histogram)
+	// AtFloatHistogram returns the current timestamp/histogram pair if
+	// ValueType is ValFloatHistogram.
+	AtFloatHistogram() (t int64, h *FloatHistogram)
+	// ValueType returns the type of the value at the current position.
+	ValueType() ValueType
+	// Next advances the iterator by one and returns the type of the
+	// new current value. It returns ValNone once exhausted.
+	Next() ValueType
+	// Err returns the current error.
+	Err() error
+}
+
+// Series represents a single time series.
+type Series interface {
+	// Labels returns the complete set of labels identifying the series.
+	Labels() labels.Labels
+	// Iterator returns a new iterator of the series.
+	Iterator() SeriesIterator
+}
+
+// SeriesSet contains a set of series.
+type SeriesSet interface {
+	Next() bool
+	At() Series
+	Err() error
+}
+
+// listSeriesSet implements SeriesSet over a plain slice of series that
+// is already sorted by label set.
+type listSeriesSet struct {
+	list []Series
+	idx  int
+}
+
+func newListSeriesSet(list []Series) *listSeriesSet {
+	return &listSeriesSet{list: list, idx: -1}
+}
+
+func (s *listSeriesSet) Next() bool {
+	s.idx++
+	return s.idx < len(s.list)
+}
+
+func (s *listSeriesSet) At() Series {
+	return s.list[s.idx]
+}
+
+func (s *listSeriesSet) Err() error {
+	return nil
+}
+
+// partitionSeriesSet merges two SeriesSets, a and b, that are each
+// sorted by label set, into a single SeriesSet sorted by label set. The
+// samples of b are assumed to strictly follow those of a for any label
+// set present in both; matching series are concatenated rather than
+// merged sample-by-sample.
+type partitionSeriesSet struct {
+	a, b SeriesSet
+
+	adone, bdone bool
+	cur          Series
+}
+
+// newPartitionSeriesSet returns a SeriesSet that merges a and b.
+func newPartitionSeriesSet(a, b SeriesSet) *partitionSeriesSet {
+	s := &partitionSeriesSet{a: a, b: b}
+	s.adone = !s.a.Next()
+	s.bdone = !s.b.Next()
+	return s
+}
+
+func (s *partitionSeriesSet) At() Series {
+	return s.cur
+}
+
+func (s *partitionSeriesSet) Err() error {
+	if err := s.a.Err(); err != nil {
+		return err
+	}
+	return s.b.Err()
+}
+
+// compare returns <0 if a sorts before b, >0 if b sorts before a, and 0
+// if both point at equal label sets.
+func (s *partitionSeriesSet) compare() int {
+	if s.adone {
+		return 1
+	}
+	if s.bdone {
+		return -1
+	}
+	return labels.Compare(s.a.At().Labels(), s.b.At().Labels())
+}
+
+func (s *partitionSeriesSet) Next() bool {
+	if s.adone && s.bdone {
+		return false
+	}
+
+	d := s.compare()
+
+	switch {
+	case d > 0:
+		s.cur = s.b.At()
+		s.bdone = !s.b.Next()
+	case d < 0:
+		s.cur = s.a.At()
+		s.adone = !s.a.Next()
+	default:
+		s.cur = &chainedSeries{series: []Series{s.a.At(), s.b.At()}}
+		s.adone = !s.a.Next()
+		s.bdone = !s.b.Next()
+	}
+	return true
+}
+
+// listSeriesIterator iterates over a pre-built list of samples, each of
+// which may be a float, histogram, or float-histogram sample. It
+// backs listChunk and is also used directly by tests.
+type listSeriesIterator struct {
+	list []sample
+	idx  int
+}
+
+func newListSeriesIterator(list []sample) *listSeriesIterator {
+	return &listSeriesIterator{list: list, idx: -1}
+}
+
+func (it *listSeriesIterator) At() (int64, float64) {
+	s := it.list[it.idx]
+	return s.t, s.v
+}
+
+func (it *listSeriesIterator) AtHistogram() (int64, *Histogram) {
+	s := it.list[it.idx]
+	return s.t, s.h
+}
+
+func (it *listSeriesIterator) AtFloatHistogram() (int64, *FloatHistogram) {
+	s := it.list[it.idx]
+	return s.t, s.fh
+}
+
+func (it *listSeriesIterator) ValueType() ValueType {
+	if it.idx < 0 || it.idx >= len(it.list) {
+		return ValNone
+	}
+	return it.list[it.idx].valueType()
+}
+
+func (it *listSeriesIterator) Next() ValueType {
+	it.idx++
+	if it.idx >= len(it.list) {
+		return ValNone
+	}
+	return it.list[it.idx].valueType()
+}
+
+func (it *listSeriesIterator) Seek(t int64) ValueType {
+	if it.idx == -1 {
+		it.idx = 0
+	}
+	// Do binary search between current position and end.
+	start := it.idx
+	it.idx = start + sort.Search(len(it.list)-start, func(i int) bool {
+		s := it.list[i+start]
+		return s.t >= t
+	})
+
+	if it.idx >= len(it.list) {
+		return ValNone
+	}
+	return it.list[it.idx].valueType()
+}
+
+func (it *listSeriesIterator) Err() error {
+	return nil
+}
+
+// expandSeriesIterator drains it into a plain slice of samples,
+// preserving whichever value kind each step yields.
+func expandSeriesIterator(it SeriesIterator) (r []sample, err error) {
+	for typ := it.Next(); typ != ValNone; typ = it.Next() {
+		switch typ {
+		case ValHistogram:
+			t, h := it.AtHistogram()
+			r = append(r, sample{t: t, h: h})
+		case ValFloatHistogram:
+			t, fh := it.AtFloatHistogram()
+			r = append(r, sample{t: t, fh: fh})
+		default:
+			t, v := it.At()
+			r = append(r, sample{t: t, v: v})
+		}
+	}
+
+	return r, it.Err()
+}
+
+// chainedSeries concatenates the samples of a list of series that share
+// the same label set, in the order given.
+type chainedSeries struct {
+	series []Series
+}
+
+func (s *chainedSeries) Labels() labels.Labels {
+	return s.series[0].Labels()
+}
+
+func (s *chainedSeries) Iterator() SeriesIterator {
+	it := make([]SeriesIterator, len(s.series))
+	for i, series := range s.series {
+		it[i] = series.Iterator()
+	}
+	return newChainedSeriesIterator(it...)
+}
+
+// chainedSeriesIterator iterates over a list of SeriesIterators in
+// order, advancing to the next one once the current is exhausted.
+type chainedSeriesIterator struct {
+	series  []SeriesIterator
+	i       int
+	cur     SeriesIterator
+	curType ValueType
+}
+
+func newChainedSeriesIterator(series ...SeriesIterator) *chainedSeriesIterator {
+	return &chainedSeriesIterator{series: series, i: 0, cur: series[0]}
+}
+
+func (it *chainedSeriesIterator) Seek(t int64) ValueType {
+	for ; it.i < len(it.series); it.i++ {
+		it.cur = it.series[it.i]
+
+		if typ := it.cur.Seek(t); typ != ValNone {
+			it.curType = typ
+			return typ
+		}
+		if it.cur.Err() != nil {
+			it.curType = ValNone
+			return ValNone
+		}
+	}
+	it.curType = ValNone
+	return ValNone
+}
+
+func (it *chainedSeriesIterator) Next() ValueType {
+	if typ := it.cur.Next(); typ != ValNone {
+		it.curType = typ
+		return typ
+	}
+	if it.cur.Err() != nil {
+		it.curType = ValNone
+		return ValNone
+	}
+	if it.i == len(it.series)-1 {
+		it.curType = ValNone
+		return ValNone
+	}
+	it.i++
+	it.cur = it.series[it.i]
+	return it.Next()
+}
+
+func (it *chainedSeriesIterator) At() (t int64, v float64) {
+	return it.cur.At()
+}
+
+func (it *chainedSeriesIterator) AtHistogram() (t int64, h *Histogram) {
+	return it.cur.AtHistogram()
+}
+
+func (it *chainedSeriesIterator) AtFloatHistogram() (t int64, h *FloatHistogram) {
+	return it.cur.AtFloatHistogram()
+}
+
+func (it *chainedSeriesIterator) ValueType() ValueType {
+	return it.curType
+}
+
+func (it *chainedSeriesIterator) Err() error {
+	return it.cur.Err()
+}
@@ -2,7 +2,6 @@ package tsdb
 
 import (
 	"math/rand"
-	"sort"
 	"testing"
 
 	"github.com/fabxc/tsdb/labels"
@@ -10,15 +9,25 @@ import (
 )
 
 type mockSeriesIterator struct {
-	seek func(int64) bool
-	at   func() (int64, float64)
-	next func() bool
-	err  func() error
+	seek             func(int64) ValueType
+	at               func() (int64, float64)
+	atHistogram      func() (int64, *Histogram)
+	atFloatHistogram func() (int64, *FloatHistogram)
+	valueType        func() ValueType
+	next             func() ValueType
+	err              func() error
 }
 
-func (m *mockSeriesIterator) Seek(t int64) bool    { return m.seek(t) }
-func (m *mockSeriesIterator) At() (int64, float64) { return m.at() }
-func (m *mockSeriesIterator) Next() bool           { return m.next() }
+func (m *mockSeriesIterator) Seek(t int64) ValueType { return m.seek(t) }
+func (m *mockSeriesIterator) At() (int64, float64)   { return m.at() }
+func (m *mockSeriesIterator) AtHistogram() (int64, *Histogram) {
+	return m.atHistogram()
+}
+func (m *mockSeriesIterator) AtFloatHistogram() (int64, *FloatHistogram) {
+	return m.atFloatHistogram()
+}
+func (m *mockSeriesIterator) ValueType() ValueType { return m.valueType() }
+func (m *mockSeriesIterator) Next() ValueType      { return m.next() }
 func (m *mockSeriesIterator) Err() error           { return m.err() }
 
 type mockSeries struct {
@@ -29,42 +38,6 @@ type mockSeries struct {
 func (m *mockSeries) Labels() labels.Labels    { return m.labels() }
 func (m *mockSeries) Iterator() SeriesIterator { return m.iterator() }
 
-type listSeriesIterator struct {
-	list []sample
-	idx  int
-}
-
-func newListSeriesIterator(list []sample) *listSeriesIterator {
-	return &listSeriesIterator{list: list, idx: -1}
-}
-
-func (it *listSeriesIterator) At() (int64, float64) {
-	s := it.list[it.idx]
-	return s.t, s.v
-}
-
-func (it *listSeriesIterator) Next() bool {
-	it.idx++
-	return it.idx < len(it.list)
-}
-
-func (it *listSeriesIterator) Seek(t int64) bool {
-	if it.idx == -1 {
-		it.idx = 0
-	}
-	// Do binary search between current position and end.
-	it.idx = sort.Search(len(it.list)-it.idx, func(i int) bool {
-		s := it.list[i+it.idx]
-		return s.t >= t
-	})
-
-	return it.idx < len(it.list)
-}
-
-func (it *listSeriesIterator) Err() error {
-	return nil
-}
-
 func TestPartitionSeriesSet(t *testing.T) {
 	newSeries := func(l map[string]string, s []sample) Series {
 		return &mockSeries{
@@ -193,15 +166,6 @@ Outer:
 	}
 }
 
-func expandSeriesIterator(it SeriesIterator) (r []sample, err error) {
-	for it.Next() {
-		t, v := it.At()
-		r = append(r, sample{t: t, v: v})
-	}
-
-	return r, it.Err()
-}
-
 func TestSampleRing(t *testing.T) {
 	cases := []struct {
 		input []int64
@@ -229,6 +193,67 @@ func TestSampleRing(t *testing.T) {
 			size:  1,
 		},
 	}
+	newRings := map[string]func(delta int64, size int) ring{
+		"dense":      func(delta int64, size int) ring { return newSampleRing(delta, size) },
+		"compressed": func(delta int64, size int) ring { return newCompressedSampleRing(delta, size) },
+	}
+
+	for name, newRing := range newRings {
+		for _, c := range cases {
+			r := newRing(c.delta, c.size)
+
+			input := []sample{}
+			for _, t := range c.input {
+				input = append(input, sample{
+					t: t,
+					v: float64(rand.Intn(100)),
+				})
+			}
+
+			for i, s := range input {
+				r.add(s)
+				buffered := r.samples()
+
+				for _, sold := range input[:i] {
+					found := false
+					for _, bs := range buffered {
+						if bs.t == sold.t && bs.v == sold.v {
+							found = true
+							break
+						}
+					}
+					if sold.t >= s.t-c.delta && !found {
+						t.Fatalf("%s, %d: expected sample %d to be in buffer but was not; buffer %v", name, i, sold.t, buffered)
+					}
+					if sold.t < s.t-c.delta && found {
+						t.Fatalf("%s, %d: unexpected sample %d in buffer; buffer %v", name, i, sold.t, buffered)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestSampleRingHistogram mirrors TestSampleRing but buffers native
+// histogram samples, verifying that eviction is driven by timestamp
+// regardless of the sample kind held in the ring.
+func TestSampleRingHistogram(t *testing.T) {
+	cases := []struct {
+		input []int64
+		delta int64
+		size  int
+	}{
+		{
+			input: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			delta: 2,
+			size:  1,
+		},
+		{
+			input: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			delta: 7,
+			size:  3,
+		},
+	}
 	for _, c := range cases {
 		r := newSampleRing(c.delta, c.size)
 
@@ -236,30 +261,92 @@ func TestSampleRing(t *testing.T) {
 		for _, t := range c.input {
 			input = append(input, sample{
 				t: t,
-				v: float64(rand.Intn(100)),
+				h: &Histogram{Count: uint64(t), Sum: float64(t)},
+			})
+		}
+
+		for i, s := range input {
+			r.add(s)
+			buffered := r.samples()
+
+			for _, sold := range input[:i] {
+				found := false
+				for _, bs := range buffered {
+					if bs.t == sold.t && bs.h != nil && bs.h.Count == sold.h.Count {
+						found = true
+						break
+					}
+				}
+				if sold.t >= s.t-c.delta && !found {
+					t.Fatalf("%d: expected histogram sample %d to be in buffer but was not; buffer %v", i, sold.t, buffered)
+				}
+				if sold.t < s.t-c.delta && found {
+					t.Fatalf("%d: unexpected histogram sample %d in buffer; buffer %v", i, sold.t, buffered)
+				}
+			}
+		}
+
+		for _, bs := range r.samples() {
+			require.Equal(t, ValHistogram, bs.valueType(), "expected buffered sample to stay typed as a histogram")
+		}
+	}
+}
+
+// TestSampleRingFloatHistogram mirrors TestSampleRingHistogram but
+// buffers float histogram samples, verifying that eviction is driven
+// by timestamp regardless of the sample kind held in the ring.
+func TestSampleRingFloatHistogram(t *testing.T) {
+	cases := []struct {
+		input []int64
+		delta int64
+		size  int
+	}{
+		{
+			input: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			delta: 2,
+			size:  1,
+		},
+		{
+			input: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			delta: 7,
+			size:  3,
+		},
+	}
+	for _, c := range cases {
+		r := newSampleRing(c.delta, c.size)
+
+		input := []sample{}
+		for _, t := range c.input {
+			input = append(input, sample{
+				t:  t,
+				fh: &FloatHistogram{Count: float64(t), Sum: float64(t)},
 			})
 		}
 
 		for i, s := range input {
-			r.add(s.t, s.v)
+			r.add(s)
 			buffered := r.samples()
 
 			for _, sold := range input[:i] {
 				found := false
 				for _, bs := range buffered {
-					if bs.t == sold.t && bs.v == sold.v {
+					if bs.t == sold.t && bs.fh != nil && bs.fh.Count == sold.fh.Count {
 						found = true
 						break
 					}
 				}
 				if sold.t >= s.t-c.delta && !found {
-					t.Fatalf("%d: expected sample %d to be in buffer but was not; buffer %v", i, sold.t, buffered)
+					t.Fatalf("%d: expected float histogram sample %d to be in buffer but was not; buffer %v", i, sold.t, buffered)
 				}
 				if sold.t < s.t-c.delta && found {
-					t.Fatalf("%d: unexpected sample %d in buffer; buffer %v", i, sold.t, buffered)
+					t.Fatalf("%d: unexpected float histogram sample %d in buffer; buffer %v", i, sold.t, buffered)
 				}
 			}
 		}
+
+		for _, bs := range r.samples() {
+			require.Equal(t, ValFloatHistogram, bs.valueType(), "expected buffered sample to stay typed as a float histogram")
+		}
 	}
 }
 
@@ -269,7 +356,7 @@ func TestBufferedSeriesIterator(t *testing.T) {
 	bufferEq := func(exp []sample) {
 		var b []sample
 		bit := it.Buffer()
-		for bit.Next() {
+		for bit.Next() != ValNone {
 			t, v := bit.At()
 			b = append(b, sample{t: t, v: v})
 		}
@@ -316,3 +403,125 @@ func TestBufferedSeriesIterator(t *testing.T) {
 
 	require.False(t, it.Next(), "next succeeded unexpectedly")
 }
+
+// TestBufferedSeriesIteratorHistogram mirrors TestBufferedSeriesIterator
+// but exercises a series made up of native histogram samples, verifying
+// that the buffer preserves them without forcing a float conversion.
+func TestBufferedSeriesIteratorHistogram(t *testing.T) {
+	hist := func(n int64) *Histogram { return &Histogram{Count: uint64(n), Sum: float64(n)} }
+
+	var it *BufferedSeriesIterator
+
+	bufferEq := func(exp []int64) {
+		var b []int64
+		bit := it.Buffer()
+		for bit.Next() != ValNone {
+			bt, bh := bit.AtHistogram()
+			require.NotNil(t, bh)
+			b = append(b, bt)
+		}
+		require.Equal(t, exp, b, "buffer mismatch")
+	}
+
+	it = NewBuffer(newListSeriesIterator([]sample{
+		{t: 1, h: hist(1)},
+		{t: 2, h: hist(2)},
+		{t: 3, h: hist(3)},
+		{t: 4, h: hist(4)},
+	}), 2)
+
+	require.True(t, it.Seek(-123), "seek failed")
+	require.Equal(t, ValHistogram, it.ValueType())
+	bufferEq(nil)
+
+	require.True(t, it.Next(), "next failed")
+	ts, h := it.AtHistogram()
+	require.Equal(t, int64(2), ts)
+	require.Equal(t, hist(2), h)
+	bufferEq([]int64{1})
+}
+
+// TestBufferedSeriesIteratorFloatHistogram mirrors
+// TestBufferedSeriesIteratorHistogram but exercises a series made up of
+// float histogram samples, verifying that the buffer preserves them
+// without forcing a conversion back to native histograms.
+func TestBufferedSeriesIteratorFloatHistogram(t *testing.T) {
+	hist := func(n int64) *FloatHistogram { return &FloatHistogram{Count: float64(n), Sum: float64(n)} }
+
+	var it *BufferedSeriesIterator
+
+	bufferEq := func(exp []int64) {
+		var b []int64
+		bit := it.Buffer()
+		for bit.Next() != ValNone {
+			bt, bh := bit.AtFloatHistogram()
+			require.NotNil(t, bh)
+			b = append(b, bt)
+		}
+		require.Equal(t, exp, b, "buffer mismatch")
+	}
+
+	it = NewBuffer(newListSeriesIterator([]sample{
+		{t: 1, fh: hist(1)},
+		{t: 2, fh: hist(2)},
+		{t: 3, fh: hist(3)},
+		{t: 4, fh: hist(4)},
+	}), 2)
+
+	require.True(t, it.Seek(-123), "seek failed")
+	require.Equal(t, ValFloatHistogram, it.ValueType())
+	bufferEq(nil)
+
+	require.True(t, it.Next(), "next failed")
+	ts, fh := it.AtFloatHistogram()
+	require.Equal(t, int64(2), ts)
+	require.Equal(t, hist(2), fh)
+	bufferEq([]int64{1})
+}
+
+// TestBufferedSeriesIteratorCompressed runs the same sequence as
+// TestBufferedSeriesIterator through a BufferedSeriesIterator backed by
+// the compressed ring, to check that the two encodings agree.
+func TestBufferedSeriesIteratorCompressed(t *testing.T) {
+	var it *BufferedSeriesIterator
+
+	bufferEq := func(exp []sample) {
+		var b []sample
+		bit := it.Buffer()
+		for bit.Next() != ValNone {
+			t, v := bit.At()
+			b = append(b, sample{t: t, v: v})
+		}
+		require.Equal(t, exp, b, "buffer mismatch")
+	}
+	sampleEq := func(ets int64, ev float64) {
+		ts, v := it.At()
+		require.Equal(t, ets, ts, "timestamp mismatch")
+		require.Equal(t, ev, v, "value mismatch")
+	}
+
+	it = NewBufferWithEncoding(newListSeriesIterator([]sample{
+		{t: 1, v: 2},
+		{t: 2, v: 3},
+		{t: 3, v: 4},
+		{t: 4, v: 5},
+		{t: 5, v: 6},
+		{t: 99, v: 8},
+		{t: 100, v: 9},
+		{t: 101, v: 10},
+	}), 2, EncCompressed)
+
+	require.True(t, it.Seek(-123), "seek failed")
+	sampleEq(1, 2)
+	bufferEq(nil)
+
+	require.True(t, it.Next(), "next failed")
+	sampleEq(2, 3)
+	bufferEq([]sample{{t: 1, v: 2}})
+
+	require.True(t, it.Seek(101), "seek failed")
+	sampleEq(101, 10)
+	bufferEq([]sample{{t: 99, v: 8}, {t: 100, v: 9}})
+
+	require.False(t, it.Next(), "next succeeded unexpectedly")
+}